@@ -1,170 +1,447 @@
 package cache
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"io"
 	"os"
 	"path"
 	"sync"
 	"time"
 )
 
+// ErrLocked is returned when a Cache is opened with WithLockMode(LockNonBlocking)
+// and another process already holds the file lock.
+var ErrLocked = errors.New("cache: file is locked")
+
+// LockMode controls how Cache waits to acquire the cross-process file lock
+// taken around New, Set and Get.
+type LockMode int
+
+const (
+	// LockBlocking waits for the lock to become available.
+	LockBlocking LockMode = iota
+	// LockNonBlocking fails immediately with ErrLocked if the lock is held.
+	LockNonBlocking
+)
+
+// Option configures a Cache at construction time.
+type Option func(*cacheOptions)
+
+type cacheOptions struct {
+	lockMode     LockMode
+	missDuration time.Duration
+}
+
+// WithLockMode sets the lock mode used for the OS-level advisory lock taken
+// around Set and Get. The default is LockBlocking.
+func WithLockMode(mode LockMode) Option {
+	return func(o *cacheOptions) {
+		o.lockMode = mode
+	}
+}
+
+// WithMissDuration overrides MissDuration for a single Cache, controlling how
+// long a SetMiss sentinel written by that Cache stays fresh.
+func WithMissDuration(d time.Duration) Option {
+	return func(o *cacheOptions) {
+		o.missDuration = d
+	}
+}
+
 type Cache[T any] struct {
 	Identifier string
 	Expire     bool
 	Expiry     time.Time
-	lock       sync.Mutex
+	// Miss and MissExpiry record a negative-cache entry written by SetMiss:
+	// while MissExpiry is in the future, Get returns ErrMissCached instead of
+	// decoding (empty) items.
+	Miss         bool
+	MissExpiry   time.Time
+	lock         sync.Mutex
+	lockMode     LockMode
+	missDuration time.Duration
+	// legacy is set when the on-disk cache was loaded from the old
+	// single-file layout; the next Set migrates it to .meta/.data.
+	legacy bool
 }
 
 var (
 	Location string
 )
 
+func metaPath(id string) string   { return path.Join(Location, id+".meta") }
+func dataPath(id string) string   { return path.Join(Location, id+".data") }
+func legacyPath(id string) string { return path.Join(Location, id) }
+
 // New creates a new Cache instance or attempts to load an existing one from disk.
 // It initializes the cache with the given identifier and expiry duration.
-// If a cache file exists, it tries to read the header and existing cache metadata.
+// If a `<id>.meta` file exists, it loads the header from it. Otherwise it falls
+// back to the legacy single-file layout (a 4-byte length header followed by the
+// gob-encoded header) so caches written before the .meta/.data split still load;
+// such a Cache is migrated to the new layout on its next Set.
 // It returns a pointer to the Cache or nil if an error occurs during file operations or decoding.
-func New[T any](id string, expiry time.Duration) *Cache[T] {
+func New[T any](id string, expiry time.Duration, opts ...Option) *Cache[T] {
+	o := cacheOptions{lockMode: LockBlocking}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	c := &Cache[T]{
-		Identifier: id,
-		Expire:     expiry != 0,
-		Expiry:     time.Now().Add(expiry),
+		Identifier:   id,
+		Expire:       expiry != 0,
+		Expiry:       time.Now().Add(expiry),
+		lockMode:     o.lockMode,
+		missDuration: o.missDuration,
 	}
-	//make a slice for the offset
-	hb := make([]byte, 4)
-	//open the file, creating if not exist
-	file, err := os.OpenFile(path.Join(Location, c.Identifier), os.O_CREATE|os.O_RDWR, 0644)
+	mf, err := os.Open(metaPath(id))
+	if err == nil {
+		defer mf.Close()
+		//take a shared lock before the header read, so a concurrent Set
+		//promoting a new .meta.tmp can't race with us decoding it
+		if err = lockFile(mf, false, o.lockMode == LockNonBlocking); err != nil {
+			return nil
+		}
+		err = gob.NewDecoder(mf).Decode(c)
+		if err == nil {
+			return c
+		}
+		//an empty .meta is only the lock file of a first Set that never
+		//completed: treat it as absent rather than as an unreadable cache
+		if err != io.EOF {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil
+	}
+	//no .meta yet: fall back to the legacy single-file layout
+	lf, err := os.Open(legacyPath(id))
 	if err != nil {
+		//nothing on disk at all, start fresh
+		return c
+	}
+	defer lf.Close()
+	if err = lockFile(lf, false, o.lockMode == LockNonBlocking); err != nil {
 		return nil
 	}
-	defer file.Close()
 	//try reading the first 4 bytes
-	_, err = file.Read(hb)
+	hb := make([]byte, 4)
+	_, err = lf.Read(hb)
 	if err != nil {
 		//if we cant read because we reach end of file return new cache
 		return c
 	}
-	//create a uint32
-	hlen := binary.LittleEndian.Uint32(hb)
-	cb := make([]byte, hlen)
 	//seek to after the offset
-	_, err = file.Seek(4, 0)
+	_, err = lf.Seek(4, 0)
 	if err != nil {
 		return c
 	}
-	//read until the end of the offset
-	_, err = file.Read(cb)
-	if err != nil {
-		return c
-	}
-	//put the bytes into a buffer
-	cbytes := bytes.NewBuffer(cb)
-	//decode those bytes into cache
-	err = gob.NewDecoder(cbytes).Decode(c)
-	if err != nil {
+	//decode the header gob that follows directly into cache
+	if err = gob.NewDecoder(lf).Decode(c); err != nil {
 		return nil
 	}
+	c.legacy = true
 	return c
 }
 
-// Set saves the provided slice of items to the cache file associated with the Cache instance.
-// It ensures thread-safe access by acquiring a lock.
-// It returns an error if the file cannot be opened or if encoding fails.
-func (c *Cache[T]) Set(items *[]T) (err error) {
+// Set saves the provided slice of items to the cache. It is a thin wrapper
+// over SetStream: the slice is fed down a channel and streamed to disk one
+// element at a time.
+func (c *Cache[T]) Set(items *[]T) error {
+	ch := make(chan T, len(*items))
+	for _, item := range *items {
+		ch <- item
+	}
+	close(ch)
+	return c.SetStream(ch)
+}
+
+// SetStream drains ch and writes its elements to the cache, one at a time,
+// using a single *gob.Encoder kept open for the whole write so the element
+// type is only described once. Each element is additionally framed with its
+// own 4-byte little-endian length, written once the element's size is known,
+// so a reader can tell a clean end-of-stream from a torn write. It writes to
+// `<id>.data.tmp` and `<id>.meta.tmp`, syncs them, and promotes both with
+// os.Rename, so a crash mid-write can never leave behind an unreadable cache.
+// It ensures thread-safe access by acquiring a lock, both in-process
+// (sync.Mutex) and across processes (an exclusive OS file lock on the meta
+// file, held for the duration of the write).
+// It returns an error if a file cannot be opened, the lock cannot be acquired,
+// encoding fails, or a rename fails.
+func (c *Cache[T]) SetStream(ch <-chan T) error {
+	return c.setStream(ch, func() {
+		//writing real data supersedes any earlier negative-cache entry
+		c.Miss = false
+	})
+}
+
+// setStream is the shared implementation behind SetStream and SetMiss. prepare
+// runs under c.lock before anything is written, so SetMiss can set its own
+// negative-cache fields in the same critical section as the write instead of
+// racing a concurrent SetStream between setting them and writing the file.
+func (c *Cache[T]) setStream(ch <-chan T, prepare func()) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	//create the buffer containing cache
-	cb := bytes.NewBuffer([]byte{})
-	//put the encoded cache into the buffer
-	err = gob.NewEncoder(cb).Encode(c)
+	prepare()
+
+	//hold an exclusive lock on the meta file for the duration of the write, so
+	//readers and other writers can't observe a half-migrated or half-written cache
+	lockHandle, err := os.OpenFile(metaPath(c.Identifier), os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
-	//get the length of the buffer
-	hl := uint32(cb.Len())
-	//make a barray to hold the uint32
-	hlb := make([]byte, 4)
-	//put the uint32 in bytes
-	binary.LittleEndian.PutUint32(hlb, hl)
-	//open file
-	file, err := os.OpenFile(path.Join(Location, c.Identifier), os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
+	defer lockHandle.Close()
+	if err = lockFile(lockHandle, true, c.lockMode == LockNonBlocking); err != nil {
 		return err
 	}
-	defer file.Close()
-	//truncate the file in case we are reusing it
-	file.Truncate(0)
-	//write the length of cache to header
-	_, err = file.Write(hlb)
+
+	dataTmp := dataPath(c.Identifier) + ".tmp"
+	df, err := os.OpenFile(dataTmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	//seek to after the length header
-	_, err = file.Seek(4, 0)
-	if err != nil {
+	if err = writeStream(df, ch); err != nil {
+		df.Close()
 		return err
 	}
-	//write cache bytes to file
-	_, err = file.ReadFrom(cb)
-	if err != nil {
+	if err = df.Sync(); err != nil {
+		df.Close()
 		return err
 	}
-	//seek to length of cache hb.Len() relative to current seek
-	_, err = file.Seek(int64(cb.Len()), 1)
-	if err != nil {
+	if err = df.Close(); err != nil {
 		return err
 	}
-	//now we can write the actual contents of the slice passed in
-	err = gob.NewEncoder(file).Encode(items)
+
+	metaTmp := metaPath(c.Identifier) + ".tmp"
+	mf, err := os.OpenFile(metaTmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	if err = gob.NewEncoder(mf).Encode(c); err != nil {
+		mf.Close()
+		return err
+	}
+	if err = mf.Sync(); err != nil {
+		mf.Close()
+		return err
+	}
+	if err = mf.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(dataTmp, dataPath(c.Identifier)); err != nil {
+		return err
+	}
+	if err = os.Rename(metaTmp, metaPath(c.Identifier)); err != nil {
+		return err
+	}
+
+	if c.legacy {
+		os.Remove(legacyPath(c.Identifier))
+		c.legacy = false
+	}
+	return nil
+}
+
+// writeStream drains ch into w, one gob-encoded, length-prefixed element at a
+// time, reusing a single *gob.Encoder for the whole stream.
+func writeStream[T any](w io.WriteSeeker, ch <-chan T) error {
+	enc := gob.NewEncoder(w)
+	lb := make([]byte, 4)
+	for item := range ch {
+		start, err := w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		//reserve space for the length prefix, patched in once the element is encoded
+		if _, err = w.Write(lb); err != nil {
+			return err
+		}
+		if err = enc.Encode(item); err != nil {
+			return err
+		}
+		end, err := w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(lb, uint32(end-start-4))
+		if _, err = w.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = w.Write(lb); err != nil {
+			return err
+		}
+		if _, err = w.Seek(end, io.SeekStart); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Get retrieves the items from the cache file.
-// It ensures thread-safe access by acquiring a lock.
-// If the cache has expired and is configured to expire, the file is removed and nil is returned.
-// It returns a pointer to the slice of items or nil if the cache is expired, the file
-// cannot be opened, or decoding fails.
-func (c *Cache[T]) Get() (items *[]T) {
+// Get retrieves the items from the cache. It is a thin wrapper over
+// GetStream: the streamed elements are collected into a slice. It always
+// drains the stream to completion, so unlike a direct GetStream call it
+// never needs to cancel early.
+func (c *Cache[T]) Get() (*[]T, error) {
+	ch, err := c.GetStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		// no data on disk (e.g. the cache had expired and was removed)
+		return nil, nil
+	}
+	items := make([]T, 0)
+	for item := range ch {
+		items = append(items, item)
+	}
+	return &items, nil
+}
+
+// GetStream returns a channel that yields the cache's items one at a time,
+// decoded with a single *gob.Decoder kept open for the whole read, bounding
+// memory use for large caches. Each element is read by its 4-byte length
+// prefix: the prefix is used both to tell a clean end-of-stream from a torn
+// write (a crashed Set leaves a partial prefix or a prefix promising more
+// bytes than were written) and, via Peek, to confirm the full element is on
+// disk before decoding it.
+//
+// The background read holds c.lock and the cross-process file lock for as
+// long as the channel has unread elements, so a caller that stops consuming
+// before the channel is drained must cancel ctx (e.g. via
+// context.WithCancel and a deferred cancel) to release them; otherwise the
+// goroutine blocks forever on the next send and every later Get/Set for this
+// identifier wedges behind it.
+//
+// If the cache has expired and is configured to expire, the cache files are
+// removed and a nil channel is returned.
+// It returns a non-nil error if the lock cannot be acquired or a file cannot
+// be opened; errors partway through the stream simply end it early.
+func (c *Cache[T]) GetStream(ctx context.Context) (<-chan T, error) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	//assign items
-	items = &[]T{}
+	//a still-fresh negative-cache entry from SetMiss short-circuits the read entirely
+	if c.Miss && c.MissExpiry.After(time.Now()) {
+		c.lock.Unlock()
+		return nil, ErrMissCached
+	}
+	c.Miss = false
 	//check for expiry
 	if c.Expiry.Before(time.Now()) && c.Expire {
-		os.Remove(path.Join(Location, c.Identifier))
-		return nil
+		os.Remove(legacyPath(c.Identifier))
+		os.Remove(dataPath(c.Identifier))
+		os.Remove(metaPath(c.Identifier))
+		c.lock.Unlock()
+		return nil, nil
 	}
-	//open the file
-	file, err := os.OpenFile(path.Join(Location, c.Identifier), os.O_CREATE|os.O_RDWR, 0644)
+	if c.legacy {
+		defer c.lock.Unlock()
+		items, err := c.getLegacy()
+		if err != nil {
+			return nil, err
+		}
+		out := make(chan T, len(*items))
+		for _, item := range *items {
+			out <- item
+		}
+		close(out)
+		return out, nil
+	}
+
+	mf, err := os.Open(metaPath(c.Identifier))
 	if err != nil {
-		return nil
+		c.lock.Unlock()
+		return nil, err
 	}
-	defer file.Close()
-	//read the offset to read from into hb
-	hb := make([]byte, 4)
-	_, err = file.Read(hb)
+	//take a shared lock for the duration of the read; released when file is closed below
+	if err = lockFile(mf, false, c.lockMode == LockNonBlocking); err != nil {
+		mf.Close()
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	df, err := os.Open(dataPath(c.Identifier))
 	if err != nil {
-		return nil
+		mf.Close()
+		c.lock.Unlock()
+		return nil, err
 	}
-	//seek to after the header
-	_, err = file.Seek(4, 0)
+
+	out := make(chan T)
+	go func() {
+		defer c.lock.Unlock()
+		defer mf.Close()
+		defer df.Close()
+		defer close(out)
+		readStream(ctx, df, out)
+	}()
+	return out, nil
+}
+
+// readStream decodes length-prefixed, gob-encoded elements from r into out
+// using a single *gob.Decoder, stopping cleanly at a clean end-of-stream, a
+// truncated length prefix, or a length prefix that promises more bytes than
+// are actually left in r. It reads the length prefixes through the same
+// *bufio.Reader the decoder uses internally, so the two never disagree about
+// the current file position. Sending an element honors ctx, so a caller that
+// cancels ctx after reading only some elements unblocks the send and lets
+// the caller's deferred cleanup (lock, file descriptors) run instead of
+// waiting forever for a consumer that stopped listening.
+func readStream[T any](ctx context.Context, r io.Reader, out chan<- T) {
+	br := bufio.NewReader(r)
+	dec := gob.NewDecoder(br)
+	lb := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, lb); err != nil {
+			//clean EOF or a torn length prefix: either way, nothing more to read
+			return
+		}
+		n := binary.LittleEndian.Uint32(lb)
+		//confirm the full element is actually on disk before decoding it, so a
+		//torn write (crash mid-Encode) ends the stream cleanly here instead of
+		//surfacing as an opaque gob decode error; bufio.ErrBufferFull just
+		//means the element is bigger than the read-ahead buffer, not that it's
+		//missing, so that case falls through to the normal decode
+		if _, err := br.Peek(int(n)); err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+		var item T
+		if err := dec.Decode(&item); err != nil {
+			return
+		}
+		select {
+		case out <- item:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getLegacy reads items from the old single-file layout (a 4-byte length
+// header, the gob-encoded Cache header, then the gob-encoded items) for a
+// Cache that hasn't been migrated to .meta/.data yet.
+func (c *Cache[T]) getLegacy() (items *[]T, err error) {
+	file, err := os.Open(legacyPath(c.Identifier))
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	defer file.Close()
+	if err = lockFile(file, false, c.lockMode == LockNonBlocking); err != nil {
+		return nil, err
+	}
+	hb := make([]byte, 4)
+	if _, err = file.Read(hb); err != nil {
+		return nil, err
 	}
-	//set the seek to the offset 1 adds it to the above header seek
 	offset := binary.LittleEndian.Uint32(hb)
-	_, err = file.Seek(int64(offset), 1)
-	if err != nil {
-		return nil
+	//seek past the header gob, relative to just after the 4-byte length
+	if _, err = file.Seek(4+int64(offset), 0); err != nil {
+		return nil, err
 	}
-	//decode from the file
-	err = gob.NewDecoder(file).Decode(items)
-	if err != nil {
-		return nil
+	items = &[]T{}
+	if err = gob.NewDecoder(file).Decode(items); err != nil {
+		return nil, err
 	}
-	return items
+	return items, nil
 }
@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetAfterExpiryDoesNotHang(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("expired", time.Millisecond)
+	items := []int{1, 2, 3}
+	if err := c.Set(&items); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	done := make(chan struct{})
+	var got *[]int
+	var err error
+	go func() {
+		got, err = c.Get()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Get() on an expired cache hung")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("expected nil items for an expired cache, got %v", *got)
+	}
+}
+
+func TestGetStreamEarlyCancelReleasesLock(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("partial", time.Hour)
+	items := []int{1, 2, 3, 4, 5}
+	if err := c.Set(&items); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := c.GetStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for item := range ch {
+			if item == 2 {
+				break
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := c.Get(); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Get() after an early-cancelled GetStream never returned; lock leaked")
+	}
+}
+
+func TestLockNonBlockingReturnsErrLocked(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("locked", time.Hour)
+	items := []int{1}
+	if err := c.Set(&items); err != nil {
+		t.Fatal(err)
+	}
+
+	mf, err := os.OpenFile(metaPath("locked"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	if err := lockFile(mf, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if c2 := New[int]("locked", time.Hour, WithLockMode(LockNonBlocking)); c2 != nil {
+		t.Fatal("expected New to fail while another holder has the meta file exclusively locked")
+	}
+
+	c.lockMode = LockNonBlocking
+	if _, err := c.Get(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked from a non-blocking Get while the meta file is locked, got %v", err)
+	}
+}
+
+// writeLegacyFixture writes id's old single-file layout directly (a 4-byte
+// offset, the gob-encoded header, then the gob-encoded items), bypassing the
+// current .meta/.data writer, so New/Get can be exercised against it.
+func writeLegacyFixture(t *testing.T, id string, header *Cache[int], items []int) {
+	t.Helper()
+	var headerBuf bytes.Buffer
+	if err := gob.NewEncoder(&headerBuf).Encode(header); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(legacyPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lb := make([]byte, 4)
+	binary.LittleEndian.PutUint32(lb, uint32(headerBuf.Len()))
+	if _, err := f.Write(lb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(headerBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(&items); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyMigration(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	header := &Cache[int]{Identifier: "legacy", Expire: true, Expiry: time.Now().Add(time.Hour)}
+	writeLegacyFixture(t, "legacy", header, []int{1, 2, 3})
+
+	c := New[int]("legacy", time.Hour)
+	if c == nil {
+		t.Fatal("New failed to load the legacy single-file layout")
+	}
+	if !c.legacy {
+		t.Fatal("expected New to mark a legacy-layout load")
+	}
+
+	got, err := c.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || len(*got) != 3 {
+		t.Fatalf("expected 3 items read from the legacy file, got %v", got)
+	}
+
+	if err := c.Set(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyPath("legacy")); !os.IsNotExist(err) {
+		t.Fatal("expected Set to remove the legacy file once migrated")
+	}
+	if _, err := os.Stat(metaPath("legacy")); err != nil {
+		t.Fatalf("expected .meta to exist after migration: %v", err)
+	}
+	if _, err := os.Stat(dataPath("legacy")); err != nil {
+		t.Fatalf("expected .data to exist after migration: %v", err)
+	}
+}
+
+func TestSetMissFallsThroughAfterMissExpiry(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("miss", time.Hour, WithMissDuration(20*time.Millisecond))
+	if err := c.SetMiss(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(); !errors.Is(err, ErrMissCached) {
+		t.Fatalf("expected ErrMissCached while the miss sentinel is fresh, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	got, err := c.Get()
+	if err != nil {
+		t.Fatalf("expected the miss sentinel to fall through to normal handling once stale, got error: %v", err)
+	}
+	if got == nil || len(*got) != 0 {
+		t.Fatalf("expected zero items past miss expiry but before the cache's own expiry, got %v", got)
+	}
+}
+
+func TestGetOrFillRefillsAfterExpiry(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("refill", time.Millisecond)
+	items := []int{1, 2, 3}
+	if err := c.Set(&items); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	called := false
+	got, err := c.GetOrFill(context.Background(), func() (*[]int, error) {
+		called = true
+		v := []int{9, 9}
+		return &v, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("expected fill to run for an expired identifier, but it was never called")
+	}
+	if got == nil || len(*got) != 2 {
+		t.Fatalf("expected the fill's result, got %v", got)
+	}
+}
+
+func TestGetOrFillPanicReleasesIntent(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	c := New[int]("panicky", time.Hour)
+	func() {
+		defer func() { recover() }()
+		c.GetOrFill(context.Background(), func() (*[]int, error) {
+			panic("boom")
+		})
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		v := []int{1}
+		_, err := c.GetOrFill(context.Background(), func() (*[]int, error) {
+			return &v, nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("GetOrFill after a panicking fill never returned; intent leaked")
+	}
+}
+
+func TestGetOrFillIntentTypeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	Location = dir
+
+	Intents["shared-id"] = &Intent[string]{}
+	defer delete(Intents, "shared-id")
+
+	c := New[int]("shared-id", time.Hour)
+	_, err := c.GetOrFill(context.Background(), func() (*[]int, error) {
+		v := []int{1}
+		return &v, nil
+	})
+	if !errors.Is(err, ErrIntentTypeMismatch) {
+		t.Fatalf("expected ErrIntentTypeMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrIntentTypeMismatch is returned by GetOrFill when Intents already holds
+// an in-flight fill for this identifier registered by a Cache of a different
+// element type (e.g. two Cache[T] instances sharing an Identifier by
+// mistake).
+var ErrIntentTypeMismatch = errors.New("cache: identifier already has an in-flight fill of a different type")
+
+// Intent represents a single in-flight fill for a Cache[T] identifier. The
+// first caller to miss registers the Intent and runs the fill; anyone else
+// asking for the same identifier in the meantime waits on it instead of
+// triggering a second, redundant fill.
+type Intent[T any] struct {
+	wg     sync.WaitGroup
+	result *[]T
+	err    error
+}
+
+var (
+	intentsMu sync.Mutex
+	// Intents holds the in-flight fill for each identifier currently being
+	// populated, keyed by Cache.Identifier. Values are *Intent[T] for
+	// whatever T the registering Cache was instantiated with.
+	Intents = map[string]any{}
+)
+
+// GetOrFill returns the cached items if present and unexpired, otherwise runs
+// fill to populate the cache. A Get that yields no items (an error such as a
+// missing cache file, or the nil, nil of a cache that has expired and been
+// removed) is not a fresh hit, so it falls through to fill like any other
+// miss; only a non-nil items slice short-circuits.
+// If another goroutine is already filling the same Identifier, the caller
+// waits on that fill's result instead of running fill itself, so a
+// thundering herd of misses for the same key only does the work once. If a
+// SetMiss sentinel for this identifier is still fresh, GetOrFill returns
+// ErrMissCached without calling fill.
+func (c *Cache[T]) GetOrFill(ctx context.Context, fill func() (*[]T, error)) (*[]T, error) {
+	items, err := c.Get()
+	if err != nil && errors.Is(err, ErrMissCached) {
+		return nil, err
+	}
+	if items != nil {
+		return items, nil
+	}
+
+	intentsMu.Lock()
+	if existing, ok := Intents[c.Identifier]; ok {
+		intentsMu.Unlock()
+		in, ok := existing.(*Intent[T])
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrIntentTypeMismatch, c.Identifier)
+		}
+		return waitIntent[T](ctx, in)
+	}
+	in := &Intent[T]{}
+	in.wg.Add(1)
+	Intents[c.Identifier] = in
+	intentsMu.Unlock()
+
+	// however fill finishes - return, or panic - the intent must be cleared
+	// and waiters released, or every later GetOrFill for this identifier
+	// blocks on waitIntent until its ctx expires.
+	defer func() {
+		if r := recover(); r != nil {
+			intentsMu.Lock()
+			delete(Intents, c.Identifier)
+			intentsMu.Unlock()
+			in.wg.Done()
+			panic(r)
+		}
+	}()
+
+	in.result, in.err = fill()
+	if in.err == nil {
+		in.err = c.Set(in.result)
+	}
+
+	intentsMu.Lock()
+	delete(Intents, c.Identifier)
+	intentsMu.Unlock()
+	in.wg.Done()
+
+	return in.result, in.err
+}
+
+// waitIntent blocks until in's fill completes, or ctx is done, whichever
+// comes first.
+func waitIntent[T any](ctx context.Context, in *Intent[T]) (*[]T, error) {
+	done := make(chan struct{})
+	go func() {
+		in.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return in.result, in.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package cache
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an OS-level advisory lock on file using flock(2). A shared
+// lock is taken unless exclusive is true. If nonblocking is true, LOCK_NB is
+// added and a held lock results in ErrLocked instead of blocking. The lock is
+// released when file is closed.
+func lockFile(file *os.File, exclusive, nonblocking bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if nonblocking {
+		how |= syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(file.Fd()), how)
+	if nonblocking && errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package cache
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an OS-level advisory lock on file using LockFileEx, over the
+// same byte range flock would cover on Unix. A shared lock is taken unless
+// exclusive is true. If nonblocking is true, LOCKFILE_FAIL_IMMEDIATELY is set
+// and a held lock results in ErrLocked instead of blocking. The lock is
+// released when file is closed.
+func lockFile(file *os.File, exclusive, nonblocking bool) error {
+	var flags uint32
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if nonblocking {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	ol := new(windows.Overlapped)
+	err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, ^uint32(0), ^uint32(0), ol)
+	if nonblocking && errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
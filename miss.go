@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMissCached is returned by Get and GetStream while a SetMiss sentinel for
+// that identifier is still fresh, so callers can tell "known not to exist"
+// apart from "not yet looked up".
+var ErrMissCached = errors.New("cache: miss cached")
+
+// MissDuration is the default lifetime of a SetMiss sentinel. It is
+// deliberately much shorter than a typical hit's expiry, so callers don't
+// hammer an upstream for a key that's known not to exist, but also don't
+// trust that absence forever. Override per Cache with WithMissDuration.
+var MissDuration = time.Hour
+
+// SetMiss records that a lookup for this identifier produced no result, and
+// caches that absence for MissDuration (or the Cache's WithMissDuration
+// override) rather than the Cache's normal expiry. While the sentinel is
+// fresh, Get and GetStream return ErrMissCached instead of decoding items.
+func (c *Cache[T]) SetMiss() error {
+	ch := make(chan T)
+	close(ch)
+	return c.setStream(ch, func() {
+		md := c.missDuration
+		if md == 0 {
+			md = MissDuration
+		}
+		c.Miss = true
+		c.MissExpiry = time.Now().Add(md)
+	})
+}